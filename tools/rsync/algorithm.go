@@ -9,6 +9,7 @@
 package rsync
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"fmt"
@@ -22,9 +23,38 @@ import (
 // If no BlockSize is specified in the rsync instance, this value is used.
 const DefaultBlockSize = 1024 * 6
 
+// Defaults used in ContentDefinedChunking mode when the corresponding field
+// on rsync is left at zero. AvgBlockSize must be a power of two, since its
+// log2 is used as the number of low bits tested on the rolling hash's beta
+// component (see cdc_mask) to locate a chunk boundary.
+const (
+	DefaultMinBlockSize = 1024 * 2
+	DefaultAvgBlockSize = 1024 * 8
+	DefaultMaxBlockSize = 1024 * 64
+)
+
+// The size, in bytes, of the sliding window used by the bup-style rolling
+// hash that locates content-defined chunk boundaries.
+const cdcWindowSize = 64
+
 // Internal constant used in rolling checksum.
 const _M = 1 << 16
 
+// How blocks are cut out of the target when computing a signature or a diff.
+type ChunkingMode int // enum
+
+const (
+	// Split the target into fixed-size blocks of BlockSize, except for the
+	// final, possibly short, block. Simple and cheap, but a single
+	// insertion near the start of the target misaligns every block after it.
+	FixedBlocks ChunkingMode = iota
+	// Content-defined chunking (CDC): block boundaries are placed using a
+	// rolling hash over the target's bytes, so they track content rather
+	// than position. An edit only perturbs the chunk(s) containing it;
+	// everything after the edit re-aligns with the old chunk boundaries.
+	ContentDefinedChunking
+)
+
 // Operation Types.
 type OpType byte // enum
 
@@ -33,6 +63,8 @@ const (
 	OpData
 	OpHash
 	OpBlockRange
+	// Like OpData but Data is compressed with Codec; see SetDataCodec.
+	OpCompressedData
 )
 
 type xxh3_128 struct {
@@ -73,11 +105,26 @@ type Operation struct {
 	BlockIndexEnd uint64
 	Data          []byte
 
+	// Only used when Type == OpCompressedData.
+	Codec            DataCodec
+	UncompressedSize uint32
+
 	serialized_repr []byte
 }
 
 var bin = binary.LittleEndian
 
+// uvarint_len returns the number of bytes binary.PutUvarint would need to
+// encode x.
+func uvarint_len(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
+
 func (self Operation) SerializeSize() int {
 	switch self.Type {
 	case OpBlock:
@@ -88,6 +135,8 @@ func (self Operation) SerializeSize() int {
 		return 3 + len(self.Data)
 	case OpData:
 		return 5 + len(self.Data)
+	case OpCompressedData:
+		return 2 + uvarint_len(uint64(self.UncompressedSize)) + 4 + len(self.Data)
 	}
 	return -1
 }
@@ -108,6 +157,11 @@ func (self Operation) Serialize(ans []byte) {
 	case OpData:
 		bin.PutUint32(ans[1:], uint32(len(self.Data)))
 		copy(ans[5:], self.Data)
+	case OpCompressedData:
+		ans[1] = byte(self.Codec)
+		n := binary.PutUvarint(ans[2:], uint64(self.UncompressedSize))
+		bin.PutUint32(ans[2+n:], uint32(len(self.Data)))
+		copy(ans[2+n+4:], self.Data)
 	}
 	ans[0] = byte(self.Type)
 }
@@ -154,6 +208,27 @@ func (self *Operation) Unserialize(data []byte) (n int, err error) {
 			return -1, io.ErrShortBuffer
 		}
 		self.Data = data[5:n]
+	case OpCompressedData:
+		n = 2
+		if len(data) < n {
+			return -1, io.ErrShortBuffer
+		}
+		self.Codec = DataCodec(data[1])
+		usize, m := binary.Uvarint(data[n:])
+		if m <= 0 {
+			return -1, io.ErrShortBuffer
+		}
+		n += m + 4
+		if len(data) < n {
+			return -1, io.ErrShortBuffer
+		}
+		sz := int(bin.Uint32(data[n-4:]))
+		n += sz
+		if len(data) < n {
+			return -1, io.ErrShortBuffer
+		}
+		self.UncompressedSize = uint32(usize)
+		self.Data = data[n-sz : n]
 	default:
 		return 0, fmt.Errorf("record has unknown operation type: %d", data[0])
 	}
@@ -166,24 +241,30 @@ type BlockHash struct {
 	Index      uint64
 	WeakHash   uint32
 	StrongHash uint64
+	// Length of the chunk this hash covers. In FixedBlocks mode this is
+	// BlockSize for every block except possibly the last; in
+	// ContentDefinedChunking mode it varies per chunk.
+	Length uint32
 }
 
-const BlockHashSize = 20
+const BlockHashSize = 24
 
 // Put the serialization of this BlockHash to output
 func (self BlockHash) Serialize(output []byte) {
 	bin.PutUint64(output, self.Index)
 	bin.PutUint32(output[8:], self.WeakHash)
 	bin.PutUint64(output[12:], self.StrongHash)
+	bin.PutUint32(output[20:], self.Length)
 }
 
 func (self *BlockHash) Unserialize(data []byte) (err error) {
-	if len(data) < 20 {
-		return fmt.Errorf("record too small to be a BlockHash: %d < %d", len(data), 20)
+	if len(data) < BlockHashSize {
+		return fmt.Errorf("record too small to be a BlockHash: %d < %d", len(data), BlockHashSize)
 	}
 	self.Index = bin.Uint64(data)
 	self.WeakHash = bin.Uint32(data[8:])
 	self.StrongHash = bin.Uint64(data[12:])
+	self.Length = bin.Uint32(data[20:])
 	return
 }
 
@@ -196,12 +277,85 @@ type OperationWriter func(op Operation) error
 type rsync struct {
 	BlockSize int
 
+	// How the target is split into blocks when computing a signature or a
+	// diff. Defaults to FixedBlocks.
+	ChunkingMode ChunkingMode
+	// Only used when ChunkingMode is ContentDefinedChunking. Zero means use
+	// the corresponding Default*BlockSize constant.
+	MinBlockSize, AvgBlockSize, MaxBlockSize int
+
 	// This must be non-nil before using any functions
 	hasher                  hash.Hash64
 	hasher_constructor      func() hash.Hash64
 	checksummer_constructor func() hash.Hash
 	checksummer             hash.Hash
 	buffer                  []byte
+
+	// Cumulative byte offset of each signature block, built by SetSignature.
+	// Needed by ApplyDelta to seek to a block's location when blocks are not
+	// all BlockSize bytes long (i.e. whenever ChunkingMode is
+	// ContentDefinedChunking).
+	block_offsets []uint64
+
+	// Set by SetDataCodec. When non-nil, OpData payloads are opportunistically
+	// compressed into OpCompressedData ones.
+	codec_id            DataCodec
+	encoder_constructor func() Encoder
+	decoder_constructor func() Decoder
+	decoder             Decoder
+}
+
+// SetDataCodec configures compression of OpData payloads emitted by CreateDiff
+// into OpCompressedData ones tagged with id, and configures ApplyDelta to
+// decode OpCompressedData payloads tagged with id. id is carried over the
+// wire in every OpCompressedData so the receiving side can reject a codec it
+// wasn't configured for; negotiate it out of band before calling CreateDelta.
+func (r *rsync) SetDataCodec(id DataCodec, enc func() Encoder, dec func() Decoder) {
+	r.codec_id = id
+	r.encoder_constructor = enc
+	r.decoder_constructor = dec
+}
+
+// cdc_params returns the effective Min/Avg/MaxBlockSize, substituting the
+// Default*BlockSize constants for any that are left at zero.
+func (r *rsync) cdc_params() (min, avg, max int) {
+	min, avg, max = r.MinBlockSize, r.AvgBlockSize, r.MaxBlockSize
+	if min == 0 {
+		min = DefaultMinBlockSize
+	}
+	if avg == 0 {
+		avg = DefaultAvgBlockSize
+	}
+	if max == 0 {
+		max = DefaultMaxBlockSize
+	}
+	return
+}
+
+// cdc_mask returns the bitmask tested against the rolling hash's beta
+// component (the upper 16 bits of rolling_checksum.val) to locate a chunk
+// boundary, for the given average block size. beta, not alpha, is tested:
+// alpha is a plain byte sum over the trailing window and stays tightly
+// clustered around window_size*mean_byte_value for real-world low-entropy
+// text, so its low bits rarely walk across the full mask range; beta sums
+// position-weighted copies of alpha over time and mixes far better, which
+// is also what bup's rollsum tests.
+func cdc_mask(avg int) uint32 { return uint32(avg - 1) }
+
+// SetSignature must be called with the full signature before ApplyDelta
+// whenever the signature's blocks are not all BlockSize bytes long, i.e.
+// whenever it was generated with ChunkingMode == ContentDefinedChunking.
+// It builds a prefix-sum table of block offsets so ApplyDelta can seek
+// directly to a block instead of assuming BlockSize*BlockIndex.
+func (r *rsync) SetSignature(signature []BlockHash) {
+	r.block_offsets = make([]uint64, len(signature)+1)
+	for i, h := range signature {
+		length := uint64(h.Length)
+		if length == 0 {
+			length = uint64(r.BlockSize)
+		}
+		r.block_offsets[i+1] = r.block_offsets[i] + length
+	}
 }
 
 func (r *rsync) SetHasher(c func() hash.Hash64) {
@@ -248,14 +402,72 @@ func (self *signature_iterator) next() (ans BlockHash, err error) {
 	b := self.buffer[:n]
 	self.hasher.Reset()
 	self.hasher.Write(b)
-	ans = BlockHash{Index: self.index, WeakHash: self.rc.full(b), StrongHash: self.hasher.Sum64()}
+	ans = BlockHash{Index: self.index, WeakHash: self.rc.full(b), StrongHash: self.hasher.Sum64(), Length: uint32(len(b))}
 	self.index++
 	return
 
 }
 
+// Walks the target byte-by-byte looking for content-defined chunk
+// boundaries, used by CreateSignatureIterator when ChunkingMode is
+// ContentDefinedChunking.
+type cdc_signature_iterator struct {
+	hasher                         hash.Hash64
+	src                            *bufio.Reader
+	index                          uint64
+	min_block_size, max_block_size int
+	mask                           uint32
+}
+
+// ans is valid only iff err == nil
+func (self *cdc_signature_iterator) next() (ans BlockHash, err error) {
+	chunk := make([]byte, 0, self.max_block_size)
+	var rc rolling_checksum
+	for {
+		b, berr := self.src.ReadByte()
+		if berr != nil {
+			if berr != io.EOF {
+				return ans, berr
+			}
+			break
+		}
+		chunk = append(chunk, b)
+		n := len(chunk)
+		switch {
+		case n == cdcWindowSize:
+			rc.full(chunk[n-cdcWindowSize:])
+		case n > cdcWindowSize:
+			rc.add_one_byte(chunk[n-cdcWindowSize], b)
+		}
+		if n >= self.max_block_size {
+			break
+		}
+		if n >= self.min_block_size && n >= cdcWindowSize && (rc.val>>16)&self.mask == self.mask {
+			break
+		}
+	}
+	if len(chunk) == 0 {
+		return ans, io.EOF
+	}
+	var weak rolling_checksum
+	self.hasher.Reset()
+	self.hasher.Write(chunk)
+	ans = BlockHash{
+		Index: self.index, WeakHash: weak.full(chunk), StrongHash: self.hasher.Sum64(), Length: uint32(len(chunk)),
+	}
+	self.index++
+	return
+}
+
 // Calculate the signature of target.
 func (r *rsync) CreateSignatureIterator(target io.Reader) func() (BlockHash, error) {
+	if r.ChunkingMode == ContentDefinedChunking {
+		min, avg, max := r.cdc_params()
+		return (&cdc_signature_iterator{
+			hasher: r.hasher_constructor(), src: bufio.NewReader(target),
+			min_block_size: min, max_block_size: max, mask: cdc_mask(avg),
+		}).next
+	}
 	return (&signature_iterator{
 		hasher: r.hasher_constructor(), buffer: make([]byte, r.BlockSize), src: target,
 	}).next
@@ -267,23 +479,32 @@ func (r *rsync) ApplyDelta(alignedTarget io.Writer, target io.ReadSeeker, op Ope
 	var n int
 	var block []byte
 
-	r.set_buffer_to_size(r.BlockSize)
-	buffer := r.buffer
+	if r.ChunkingMode == ContentDefinedChunking && r.block_offsets == nil {
+		return fmt.Errorf("rsync: block_offsets is not set, call SetSignature or SetSignatureFile before ApplyDelta when ChunkingMode is ContentDefinedChunking")
+	}
+
 	if r.checksummer == nil {
 		r.checksummer = r.checksummer_constructor()
 	}
 
 	write_block := func(op Operation) error {
-		if _, err = target.Seek(int64(r.BlockSize*int(op.BlockIndex)), os.SEEK_SET); err != nil {
+		offset := int64(r.BlockSize) * int64(op.BlockIndex)
+		length := r.BlockSize
+		if r.block_offsets != nil {
+			offset = int64(r.block_offsets[op.BlockIndex])
+			length = int(r.block_offsets[op.BlockIndex+1] - r.block_offsets[op.BlockIndex])
+		}
+		if _, err = target.Seek(offset, os.SEEK_SET); err != nil {
 			return err
 		}
-		n, err = io.ReadAtLeast(target, buffer, r.BlockSize)
+		r.set_buffer_to_size(length)
+		n, err = io.ReadAtLeast(target, r.buffer, length)
 		if err != nil {
 			if err != io.ErrUnexpectedEOF {
 				return err
 			}
 		}
-		block = buffer[:n]
+		block = r.buffer[:n]
 		r.checksummer.Write(block)
 		_, err = alignedTarget.Write(block)
 		if err != nil {
@@ -320,6 +541,21 @@ func (r *rsync) ApplyDelta(alignedTarget io.Writer, target io.ReadSeeker, op Ope
 		if err != nil {
 			return err
 		}
+	case OpCompressedData:
+		if r.decoder_constructor == nil || op.Codec != r.codec_id {
+			return fmt.Errorf("cannot decode OpCompressedData using codec %d: no matching decoder configured", op.Codec)
+		}
+		if r.decoder == nil {
+			r.decoder = r.decoder_constructor()
+		}
+		decoded, derr := r.decoder.Decode(make([]byte, 0, op.UncompressedSize), op.Data)
+		if derr != nil {
+			return derr
+		}
+		r.checksummer.Write(decoded)
+		if _, err = alignedTarget.Write(decoded); err != nil {
+			return err
+		}
 	case OpHash:
 		expected := r.checksummer.Sum(nil)
 		if !bytes.Equal(expected, op.Data) {
@@ -337,48 +573,48 @@ func (r *rsync) set_buffer_to_size(sz int) {
 	}
 }
 
+// A FIFO queue of pending operations, implemented as a true doubly-linked
+// list so push_back/front/pop_front are all O(1) regardless of queue depth.
 type node struct {
-	op   *Operation
-	next *node
+	op         *Operation
+	next, prev *node
 }
 
 type list struct {
-	head *node
+	head, tail *node
 }
 
 func (self *list) push_back(op *Operation) {
-	n := &node{op: op}
-	n.next = self.head
-	self.head = n
+	n := &node{op: op, prev: self.tail}
+	if self.tail != nil {
+		self.tail.next = n
+	} else {
+		self.head = n
+	}
+	self.tail = n
 }
 
 func (self *list) is_empty() bool { return self.head == nil }
 
 func (self *list) front() *Operation {
-	for c := self.head; c != nil; c = c.next {
-		if c.next == nil {
-			return c.op
-		}
+	if self.head == nil {
+		return nil
 	}
-	return nil
+	return self.head.op
 }
 
 func (self *list) pop_front() *Operation {
-	c := self.head
-	var prev *node
-	for c != nil {
-		if c.next == nil {
-			if prev == nil {
-				self.head = nil
-			} else {
-				prev.next = nil
-			}
-			return c.op
-		}
-		prev = c
-		c = c.next
+	n := self.head
+	if n == nil {
+		return nil
 	}
-	return nil
+	self.head = n.next
+	if self.head != nil {
+		self.head.prev = nil
+	} else {
+		self.tail = nil
+	}
+	return n.op
 }
 
 // see https://rsync.samba.org/tech_report/node3.html
@@ -410,8 +646,15 @@ func (self *rolling_checksum) add_one_byte(first_byte, last_byte byte) {
 
 type diff struct {
 	buffer []byte
-	// A single β hash may correlate with many unique hashes.
-	hash_lookup map[uint32][]BlockHash
+	// Maps weak hash -> strong hash -> block index. A single weak hash may
+	// correlate with many unique strong hashes, but both levels resolve in
+	// O(1) so the common no-match case costs a single failed map lookup
+	// instead of a linear scan of every block sharing that weak hash.
+	// Populated by CreateDiff; nil when sig_file is used instead.
+	hash_lookup map[uint32]map[uint64]uint64
+	// Set by CreateDiffFromFile instead of hash_lookup, so the signature
+	// never has to be fully loaded into memory.
+	sig_file    *SignatureFile
 	source      io.Reader
 	hasher      hash.Hash64
 	checksummer hash.Hash
@@ -421,6 +664,16 @@ type diff struct {
 	finished     bool
 	rc           rolling_checksum
 
+	// Only used when chunking_mode is ContentDefinedChunking.
+	chunking_mode                  ChunkingMode
+	min_block_size, max_block_size int
+	cdc_mask                       uint32
+	cdc_rc                         rolling_checksum
+
+	// Set when the owning rsync has a codec configured via SetDataCodec.
+	codec_id DataCodec
+	encoder  Encoder
+
 	pending_op *Operation
 	ready_ops  list
 }
@@ -440,6 +693,33 @@ func (self *diff) hash(b []byte) uint64 {
 	return self.hasher.Sum64()
 }
 
+// find_match looks for window among the known blocks with the given weak
+// hash, returning its signature index if found. It consults sig_file when
+// set (CreateDiffFromFile), otherwise hash_lookup (CreateDiff). Either way
+// the strong hash of window is only computed once a candidate weak-hash
+// match exists.
+func (self *diff) find_match(weak uint32, window []byte) (block_index uint64, found bool) {
+	if self.sig_file != nil {
+		candidates := self.sig_file.Lookup(weak)
+		if len(candidates) == 0 {
+			return 0, false
+		}
+		strong := self.hash(window)
+		for _, bh := range candidates {
+			if bh.StrongHash == strong {
+				return bh.Index, true
+			}
+		}
+		return 0, false
+	}
+	mm, ok := self.hash_lookup[weak]
+	if !ok {
+		return 0, false
+	}
+	block_index, found = mm[self.hash(window)]
+	return
+}
+
 // Combine OpBlock into OpBlockRange. To do this store the previous
 // non-data operation and determine if it can be extended.
 func (self *diff) enqueue(op Operation) {
@@ -466,7 +746,7 @@ func (self *diff) enqueue(op Operation) {
 			self.pending_op = nil
 		}
 		self.pending_op = &op
-	case OpData, OpHash:
+	case OpData, OpCompressedData, OpHash:
 		if self.pending_op != nil {
 			self.ready_ops.push_back(self.pending_op)
 			self.pending_op = nil
@@ -477,15 +757,26 @@ func (self *diff) enqueue(op Operation) {
 
 }
 
+// Builds the Operation to send for a buffered, uncompressed data run,
+// compressing it with self.encoder when one is configured and doing so
+// actually shrinks the payload (so incompressible runs pay no penalty).
+func (self *diff) make_data_op(data []byte) Operation {
+	if self.encoder != nil {
+		if compressed := self.encoder.Encode(nil, data); len(compressed) < len(data) {
+			return Operation{Type: OpCompressedData, Codec: self.codec_id, UncompressedSize: uint32(len(data)), Data: compressed}
+		}
+	}
+	srepr := make([]byte, len(data)+5)
+	copy(srepr[5:], data)
+	bin.PutUint32(srepr[1:], uint32(len(data)))
+	srepr[0] = byte(OpData)
+	return Operation{Type: OpData, Data: srepr[5:], serialized_repr: srepr}
+}
+
 func (self *diff) send_data() {
 	if self.data.sz > 0 {
 		data := self.buffer[self.data.pos : self.data.pos+self.data.sz]
-		srepr := make([]byte, len(data)+5)
-		copy(srepr[5:], data)
-		bin.PutUint32(srepr[1:], uint32(len(data)))
-		srepr[0] = byte(OpData)
-		op := Operation{Type: OpData, Data: srepr[5:], serialized_repr: srepr}
-		self.enqueue(op)
+		self.enqueue(self.make_data_op(data))
 		self.data.pos += self.data.sz
 		self.data.sz = 0
 	}
@@ -548,6 +839,9 @@ func (self *diff) finish_up() {
 
 // See https://rsync.samba.org/tech_report/node4.html for the design of this algorithm
 func (self *diff) read_at_least_one_operation() (err error) {
+	if self.chunking_mode == ContentDefinedChunking {
+		return self.read_at_least_one_operation_cdc()
+	}
 	if self.window.sz > 0 {
 		if ok, err := self.ensure_idx_valid(self.window.pos + self.window.sz); !ok {
 			if err != nil {
@@ -570,11 +864,7 @@ func (self *diff) read_at_least_one_operation() (err error) {
 		self.window.sz = self.block_size
 		self.rc.full(self.buffer[self.window.pos : self.window.pos+self.window.sz])
 	}
-	found_hash := false
-	var block_index uint64
-	if hh, ok := self.hash_lookup[self.rc.val]; ok {
-		block_index, found_hash = find_hash(hh, self.hash(self.buffer[self.window.pos:self.window.pos+self.window.sz]))
-	}
+	block_index, found_hash := self.find_match(self.rc.val, self.buffer[self.window.pos:self.window.pos+self.window.sz])
 	if found_hash {
 		self.send_data()
 		self.enqueue(Operation{Type: OpBlock, BlockIndex: block_index})
@@ -585,21 +875,107 @@ func (self *diff) read_at_least_one_operation() (err error) {
 	return nil
 }
 
-func (r *rsync) CreateDiff(source io.Reader, signature []BlockHash) func() (*Operation, error) {
+// Like read_at_least_one_operation but for ContentDefinedChunking: the
+// window has no fixed size, it grows one byte at a time until the
+// bup-style rolling hash over the trailing cdcWindowSize bytes signals a
+// content-defined chunk boundary (or the chunk hits max_block_size). Unlike
+// the fixed-block algorithm, a chunk that fails to match is never searched
+// byte-by-byte for realignment: CDC boundaries are expected to resynchronize
+// with the old content on their own after the chunk(s) touched by an edit.
+func (self *diff) read_at_least_one_operation_cdc() (err error) {
+	if self.window.sz == 0 {
+		self.cdc_rc = rolling_checksum{}
+	}
+	if ok, err := self.ensure_idx_valid(self.window.pos + self.window.sz); !ok {
+		if err != nil {
+			return err
+		}
+		self.finish_up()
+		return nil
+	}
+	self.window.sz++
+	pos, sz := self.window.pos, self.window.sz
+	switch {
+	case sz == cdcWindowSize:
+		self.cdc_rc.full(self.buffer[pos+sz-cdcWindowSize : pos+sz])
+	case sz > cdcWindowSize:
+		self.cdc_rc.add_one_byte(self.buffer[pos+sz-cdcWindowSize], self.buffer[pos+sz-1])
+	}
+	if sz < self.max_block_size {
+		at_boundary := sz >= self.min_block_size && sz >= cdcWindowSize && (self.cdc_rc.val>>16)&self.cdc_mask == self.cdc_mask
+		if !at_boundary {
+			return nil
+		}
+	}
+	var wrc rolling_checksum
+	weak := wrc.full(self.buffer[pos : pos+sz])
+	block_index, found_hash := self.find_match(weak, self.buffer[pos:pos+sz])
+	if found_hash {
+		self.send_data()
+		self.enqueue(Operation{Type: OpBlock, BlockIndex: block_index})
+		self.data.pos = pos + sz
+	} else {
+		self.data.sz += sz
+	}
+	self.window.pos = pos + sz
+	self.window.sz = 0
+	return nil
+}
+
+// new_diff builds a *diff with everything set up except the actual hash
+// lookup table, which differs between CreateDiff (in-memory) and
+// CreateDiffFromFile (backed by a *SignatureFile).
+func (r *rsync) new_diff(source io.Reader, extra_buf_cap int) *diff {
+	buf_cap := r.BlockSize * 8
 	ans := &diff{
-		block_size: r.BlockSize, buffer: make([]byte, 0, (r.BlockSize * 8)),
-		hash_lookup: make(map[uint32][]BlockHash, len(signature)),
-		source:      source, hasher: r.hasher_constructor(),
-		checksummer: r.checksummer_constructor(),
+		block_size: r.BlockSize,
+		source:     source, hasher: r.hasher_constructor(),
+		checksummer:   r.checksummer_constructor(),
+		chunking_mode: r.ChunkingMode,
+	}
+	if r.ChunkingMode == ContentDefinedChunking {
+		min, avg, max := r.cdc_params()
+		ans.min_block_size, ans.max_block_size, ans.cdc_mask = min, max, cdc_mask(avg)
+		if c := max * 4; c > buf_cap {
+			buf_cap = c
+		}
+	}
+	if extra_buf_cap > buf_cap {
+		buf_cap = extra_buf_cap
 	}
+	ans.buffer = make([]byte, 0, buf_cap)
+	if r.encoder_constructor != nil {
+		ans.codec_id = r.codec_id
+		ans.encoder = r.encoder_constructor()
+	}
+	return ans
+}
+
+func (r *rsync) CreateDiff(source io.Reader, signature []BlockHash) func() (*Operation, error) {
+	ans := r.new_diff(source, 0)
+	ans.hash_lookup = make(map[uint32]map[uint64]uint64, len(signature))
 	for _, h := range signature {
-		key := h.WeakHash
-		ans.hash_lookup[key] = append(ans.hash_lookup[key], h)
+		mm := ans.hash_lookup[h.WeakHash]
+		if mm == nil {
+			mm = make(map[uint64]uint64, 1)
+			ans.hash_lookup[h.WeakHash] = mm
+		}
+		mm[h.StrongHash] = h.Index
 	}
 
 	return ans.Next
 }
 
+// CreateDiffFromFile is like CreateDiff, except the signature is consulted
+// lazily through a *SignatureFile (for example one backed by an mmap'd
+// file) instead of requiring the caller to first load every BlockHash
+// into memory.
+func (r *rsync) CreateDiffFromFile(source io.Reader, signature *SignatureFile) func() (*Operation, error) {
+	ans := r.new_diff(source, 0)
+	ans.sig_file = signature
+	return ans.Next
+}
+
 func (r *rsync) CreateDelta(source io.Reader, signature []BlockHash, ops OperationWriter) (err error) {
 	diff := r.CreateDiff(source, signature)
 	var op *Operation
@@ -625,16 +1001,6 @@ func (r *rsync) HashSize() int      { return r.hasher.Size() }
 func (r *rsync) HashBlockSize() int { return r.hasher.BlockSize() }
 func (r *rsync) HasHasher() bool    { return r.hasher != nil }
 
-// Searches for a given strong hash among all strong hashes in this bucket.
-func find_hash(hh []BlockHash, hv uint64) (uint64, bool) {
-	for _, block := range hh {
-		if block.StrongHash == hv {
-			return block.Index, true
-		}
-	}
-	return 0, false
-}
-
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -0,0 +1,314 @@
+package rsync
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func new_test_rsync() *rsync {
+	r := &rsync{BlockSize: DefaultBlockSize}
+	r.SetHasher(new_xxh3_64)
+	r.SetChecksummer(new_xxh3_128)
+	return r
+}
+
+func signature_of(r *rsync, data []byte) []BlockHash {
+	it := r.CreateSignatureIterator(bytes.NewReader(data))
+	var sig []BlockHash
+	for {
+		h, err := it()
+		if err != nil {
+			break
+		}
+		sig = append(sig, h)
+	}
+	return sig
+}
+
+func diff_ops(r *rsync, source []byte, signature []BlockHash) int {
+	diff := r.CreateDiff(bytes.NewReader(source), signature)
+	n := 0
+	for {
+		op, err := diff()
+		if op == nil {
+			if err != nil {
+				panic(err)
+			}
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// apply_ops replays ops produced against signature back into the original
+// target bytes, exercising ApplyDelta the way a real receiver would.
+func apply_ops(t *testing.T, r *rsync, target []byte, signature []BlockHash, ops []Operation) []byte {
+	t.Helper()
+	r.SetSignature(signature)
+	out := &bytes.Buffer{}
+	tr := bytes.NewReader(target)
+	for _, op := range ops {
+		if err := r.ApplyDelta(out, tr, op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return out.Bytes()
+}
+
+func collect_ops(t *testing.T, r *rsync, source []byte, signature []BlockHash) []Operation {
+	t.Helper()
+	diff := r.CreateDiff(bytes.NewReader(source), signature)
+	var ops []Operation
+	for {
+		op, err := diff()
+		if op == nil {
+			if err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+		ops = append(ops, *op)
+	}
+	return ops
+}
+
+// TestFixedBlocksRoundTrip exercises the default FixedBlocks chunking mode
+// end to end: signature -> diff -> apply, with an edit inside a single
+// block, and asserts the applied bytes exactly match the edited source.
+func TestFixedBlocksRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	target := make([]byte, 100*1024)
+	rng.Read(target)
+	source := make([]byte, len(target))
+	copy(source, target)
+	copy(source[1000:], []byte("hello world, this changes a fixed block"))
+
+	sig_r := new_test_rsync()
+	signature := signature_of(sig_r, target)
+
+	diff_r := new_test_rsync()
+	ops := collect_ops(t, diff_r, source, signature)
+
+	apply_r := new_test_rsync()
+	got := apply_ops(t, apply_r, target, signature, ops)
+	if !bytes.Equal(got, source) {
+		t.Fatalf("FixedBlocks round trip mismatch: got %d bytes, want %d bytes", len(got), len(source))
+	}
+}
+
+// TestContentDefinedChunkingRoundTrip exercises ContentDefinedChunking end
+// to end, with bytes inserted partway through the target so that the
+// blocks on either side of the insertion no longer land on the same
+// offsets, and asserts that applying the delta reproduces the source
+// exactly. How much data is retransmitted is not checked here.
+func TestContentDefinedChunkingRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	target := make([]byte, 200*1024)
+	rng.Read(target)
+
+	source := make([]byte, 0, len(target)+64)
+	source = append(source, target[:50000]...)
+	source = append(source, []byte("INSERTED-BYTES-THAT-SHIFT-EVERYTHING-AFTER-THIS-POINT")...)
+	source = append(source, target[50000:]...)
+
+	new_cdc_rsync := func() *rsync {
+		r := &rsync{BlockSize: DefaultBlockSize, ChunkingMode: ContentDefinedChunking}
+		r.SetHasher(new_xxh3_64)
+		r.SetChecksummer(new_xxh3_128)
+		return r
+	}
+
+	sig_r := new_cdc_rsync()
+	signature := signature_of(sig_r, target)
+
+	diff_r := new_cdc_rsync()
+	ops := collect_ops(t, diff_r, source, signature)
+
+	apply_r := new_cdc_rsync()
+	got := apply_ops(t, apply_r, target, signature, ops)
+	if !bytes.Equal(got, source) {
+		t.Fatalf("ContentDefinedChunking round trip mismatch: got %d bytes, want %d bytes", len(got), len(source))
+	}
+}
+
+// TestApplyDeltaRequiresSignatureForCDC checks that ApplyDelta fails fast,
+// rather than silently reading the wrong bytes, when block_offsets hasn't
+// been populated via SetSignature/SetSignatureFile for a delta generated in
+// ContentDefinedChunking mode.
+func TestApplyDeltaRequiresSignatureForCDC(t *testing.T) {
+	r := &rsync{BlockSize: DefaultBlockSize, ChunkingMode: ContentDefinedChunking}
+	r.SetHasher(new_xxh3_64)
+	r.SetChecksummer(new_xxh3_128)
+	err := r.ApplyDelta(&bytes.Buffer{}, bytes.NewReader(nil), Operation{Type: OpBlock, BlockIndex: 0})
+	if err == nil {
+		t.Fatalf("expected ApplyDelta to fail fast when block_offsets is unset in ContentDefinedChunking mode")
+	}
+}
+
+// BenchmarkDiffWeakHashCollisions exercises the worst case for hash_lookup:
+// a target made up of many distinct blocks that all share the same weak
+// hash (same byte sum and same position-weighted byte sum), forcing every
+// lookup into the same bucket and relying on the nested strong-hash map,
+// rather than a linear scan, to tell them apart.
+func BenchmarkDiffWeakHashCollisions(b *testing.B) {
+	block := DefaultBlockSize
+	blocks := 4096
+	target := make([]byte, block*blocks)
+	for i := 0; i < blocks; i++ {
+		// every block is all ones plus a +1,-1,-1,+1 pattern at offset i,
+		// which changes neither the byte sum nor the position-weighted sum
+		// (so the weak hash is the same), while its offset differs from
+		// block to block, so strong hashes still differ.
+		start := i * block
+		for j := 0; j < block; j++ {
+			target[start+j] = 1
+		}
+		target[start+i] += 1
+		target[start+i+1] -= 1
+		target[start+i+2] -= 1
+		target[start+i+3] += 1
+	}
+	source := make([]byte, len(target))
+	copy(source, target)
+
+	r := new_test_rsync()
+	signature := signature_of(r, target)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := new_test_rsync()
+		diff_ops(r, source, signature)
+	}
+}
+
+// BenchmarkDiffFragmentedDelta exercises the ready_ops queue under a
+// highly fragmented delta: a single byte changed every other block, so
+// CreateDiff alternates OpBlock/OpData for the entire target and
+// ready_ops.push_back/pop_front run once per block.
+func BenchmarkDiffFragmentedDelta(b *testing.B) {
+	block := DefaultBlockSize
+	blocks := 8192
+	target := make([]byte, block*blocks)
+	rng := rand.New(rand.NewSource(42))
+	rng.Read(target)
+	source := make([]byte, len(target))
+	copy(source, target)
+	for i := 0; i < blocks; i += 2 {
+		source[i*block] ^= 0xff
+	}
+
+	r := new_test_rsync()
+	signature := signature_of(r, target)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := new_test_rsync()
+		diff_ops(r, source, signature)
+	}
+}
+
+// TestCompressedDataRoundTrip exercises SetDataCodec end to end: a diff
+// whose OpData payloads compress well is expected to ship as
+// OpCompressedData, and ApplyDelta must decode them back to the original
+// bytes. It also round-trips a single OpCompressedData through
+// Serialize/Unserialize to check the wire format.
+func TestCompressedDataRoundTrip(t *testing.T) {
+	target := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 2000)
+	source := append(append([]byte{}, target[:1000]...), append([]byte("SOME NEW TEXT INSERTED HERE "), target[1000:]...)...)
+
+	sig_r := new_test_rsync()
+	signature := signature_of(sig_r, target)
+
+	diff_r := new_test_rsync()
+	diff_r.SetDataCodec(SnappyCodec, NewSnappyEncoder, NewSnappyDecoder)
+	ops := collect_ops(t, diff_r, source, signature)
+
+	saw_compressed := false
+	for _, op := range ops {
+		if op.Type == OpCompressedData {
+			saw_compressed = true
+		}
+	}
+	if !saw_compressed {
+		t.Fatalf("expected at least one OpCompressedData op")
+	}
+
+	apply_r := new_test_rsync()
+	apply_r.SetDataCodec(SnappyCodec, NewSnappyEncoder, NewSnappyDecoder)
+	got := apply_ops(t, apply_r, target, signature, ops)
+	if !bytes.Equal(got, source) {
+		t.Fatalf("compressed round trip mismatch: got %d bytes, want %d bytes", len(got), len(source))
+	}
+
+	for _, op := range ops {
+		if op.Type != OpCompressedData {
+			continue
+		}
+		buf := make([]byte, op.SerializeSize())
+		op.Serialize(buf)
+		var got_op Operation
+		n, err := got_op.Unserialize(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(buf) || got_op.Codec != op.Codec || got_op.UncompressedSize != op.UncompressedSize || !bytes.Equal(got_op.Data, op.Data) {
+			t.Fatalf("OpCompressedData serialize round trip mismatch")
+		}
+	}
+}
+
+// TestContentDefinedChunkingLogPrepend exercises a realistic, low-entropy
+// workload: structured, repetitive log lines, with a batch of new lines
+// prepended (as happens on every log rotation). Random-byte round-trip
+// tests don't exercise this because random data gives the rolling hash a
+// uniform distribution to work with; repetitive text does not, and is the
+// scenario CDC chunking is specifically meant to help with.
+func TestContentDefinedChunkingLogPrepend(t *testing.T) {
+	line := func(i int) string {
+		return fmt.Sprintf("2026-07-26T12:%02d:%02d INFO worker-%d: processed batch %d ok\n", i%60, (i*7)%60, i%8, i)
+	}
+	var target_buf bytes.Buffer
+	for i := 0; i < 4000; i++ {
+		target_buf.WriteString(line(i))
+	}
+	target := target_buf.Bytes()
+
+	var prefix bytes.Buffer
+	for i := 4000; i < 4050; i++ {
+		prefix.WriteString(line(i))
+	}
+	source := append(append([]byte{}, prefix.Bytes()...), target...)
+
+	new_cdc_rsync := func() *rsync {
+		r := &rsync{BlockSize: DefaultBlockSize, ChunkingMode: ContentDefinedChunking}
+		r.SetHasher(new_xxh3_64)
+		r.SetChecksummer(new_xxh3_128)
+		return r
+	}
+
+	sig_r := new_cdc_rsync()
+	signature := signature_of(sig_r, target)
+
+	diff_r := new_cdc_rsync()
+	ops := collect_ops(t, diff_r, source, signature)
+
+	var data_bytes int
+	for _, op := range ops {
+		if op.Type == OpData {
+			data_bytes += len(op.Data)
+		}
+	}
+	t.Logf("ops=%d dataBytes=%d of %d", len(ops), data_bytes, len(source))
+	if data_bytes > len(source)/2 {
+		t.Fatalf("CDC failed to resync after a log-rotation-style prepend: retransmitted %d of %d bytes", data_bytes, len(source))
+	}
+
+	apply_r := new_cdc_rsync()
+	got := apply_ops(t, apply_r, target, signature, ops)
+	if !bytes.Equal(got, source) {
+		t.Fatalf("round trip mismatch: got %d bytes, want %d bytes", len(got), len(source))
+	}
+}
@@ -0,0 +1,80 @@
+package rsync
+
+import (
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encoder compresses src, appending the result to dst (which may be nil)
+// and returning the resulting slice. Used by rsync.SetDataCodec to compress
+// OpData payloads into OpCompressedData ones.
+type Encoder interface {
+	Encode(dst, src []byte) []byte
+}
+
+// Decoder decompresses src, appending the result to dst (which may be nil)
+// and returning the resulting slice. Used by rsync.SetDataCodec to decode
+// OpCompressedData payloads in ApplyDelta.
+type Decoder interface {
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+// DataCodec identifies the compressor used for an OpCompressedData payload.
+// It is sent over the wire as part of the operation so the receiving side
+// knows which Decoder to use, and can reject codecs it doesn't support.
+type DataCodec byte
+
+const (
+	NoCodec DataCodec = iota
+	ZstdCodec
+	SnappyCodec
+)
+
+type zstd_encoder struct{ *zstd.Encoder }
+
+func (self zstd_encoder) Encode(dst, src []byte) []byte { return self.EncodeAll(src, dst) }
+
+type zstd_decoder struct{ *zstd.Decoder }
+
+func (self zstd_decoder) Decode(dst, src []byte) ([]byte, error) { return self.DecodeAll(src, dst) }
+
+// NewZstdEncoder returns an Encoder backed by github.com/klauspost/compress/zstd,
+// for use with SetDataCodec.
+func NewZstdEncoder() Encoder {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		panic(err) // only happens for invalid options, and we pass none
+	}
+	return zstd_encoder{enc}
+}
+
+// NewZstdDecoder returns a Decoder backed by github.com/klauspost/compress/zstd,
+// for use with SetDataCodec.
+func NewZstdDecoder() Decoder {
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		panic(err) // only happens for invalid options, and we pass none
+	}
+	return zstd_decoder{dec}
+}
+
+type snappy_codec struct{}
+
+// snappy.Encode/Decode write from dst[0] rather than appending, so their
+// output is appended to dst here to honour the Encoder/Decoder contract.
+func (snappy_codec) Encode(dst, src []byte) []byte { return append(dst, snappy.Encode(nil, src)...) }
+func (snappy_codec) Decode(dst, src []byte) ([]byte, error) {
+	decoded, err := snappy.Decode(nil, src)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, decoded...), nil
+}
+
+// NewSnappyEncoder returns an Encoder backed by github.com/klauspost/compress/snappy,
+// for use with SetDataCodec.
+func NewSnappyEncoder() Encoder { return snappy_codec{} }
+
+// NewSnappyDecoder returns a Decoder backed by github.com/klauspost/compress/snappy,
+// for use with SetDataCodec.
+func NewSnappyDecoder() Decoder { return snappy_codec{} }
@@ -0,0 +1,246 @@
+package rsync
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/zeebo/xxh3"
+)
+
+// On-disk layout of a signature file, written by WriteSignature and read by
+// Open:
+//
+//	magic (8 bytes)
+//	header (signatureHeaderSize bytes)
+//	BlockCount * BlockHashSize bytes of packed, serialized BlockHash records
+//	footer: checksum (8 bytes, little endian) over everything above: the xxh3
+//	hash of magic+header, then chained through each record in turn with
+//	xxh3.HashSeed(record, previous)
+//
+// This lets a reader mmap the file (or otherwise use an io.ReaderAt) and
+// consult a signature with millions of blocks without keeping every
+// BlockHash in memory: Open reads the records once, to verify the checksum
+// and build a weak-hash index, and afterwards records are read from the
+// file on demand.
+const signatureMagic = "KTYSIG01"
+
+const signatureHeaderSize = 36
+
+// Identifies the strong hash algorithm used to build a signature file. Only
+// one is defined today; the field exists so the format can grow without
+// breaking readers of old files.
+const StrongHashXXH3_64 byte = 1
+
+type signatureHeader struct {
+	ChunkingMode                             ChunkingMode
+	StrongHashID                             byte
+	BlockSize                                uint32
+	MinBlockSize, AvgBlockSize, MaxBlockSize uint32
+	BlockCount                               uint64
+	TargetLength                             uint64
+}
+
+func (h signatureHeader) serialize(out []byte) {
+	out[0] = byte(h.ChunkingMode)
+	out[1] = h.StrongHashID
+	bin.PutUint32(out[4:], h.BlockSize)
+	bin.PutUint32(out[8:], h.MinBlockSize)
+	bin.PutUint32(out[12:], h.AvgBlockSize)
+	bin.PutUint32(out[16:], h.MaxBlockSize)
+	bin.PutUint64(out[20:], h.BlockCount)
+	bin.PutUint64(out[28:], h.TargetLength)
+}
+
+func (h *signatureHeader) unserialize(data []byte) {
+	h.ChunkingMode = ChunkingMode(data[0])
+	h.StrongHashID = data[1]
+	h.BlockSize = bin.Uint32(data[4:])
+	h.MinBlockSize = bin.Uint32(data[8:])
+	h.AvgBlockSize = bin.Uint32(data[12:])
+	h.MaxBlockSize = bin.Uint32(data[16:])
+	h.BlockCount = bin.Uint64(data[20:])
+	h.TargetLength = bin.Uint64(data[28:])
+}
+
+// WriteSignature writes the output of r.CreateSignatureIterator to output
+// as a versioned signature file, for later reading via Open. The header
+// records r's ChunkingMode, plus r.BlockSize in FixedBlocks mode or the
+// effective Min/Avg/MaxBlockSize (zero fields replaced by their defaults,
+// BlockSize stored as zero) in ContentDefinedChunking mode, rather than
+// guessing them back from the blocks themselves (a FixedBlocks target
+// whose length isn't a multiple of BlockSize has a short final block,
+// which looks just like a ContentDefinedChunking one if you only look at
+// block lengths). Output is not streamed: every BlockHash from iter is
+// collected in memory (BlockHashSize bytes each) to learn the block count
+// and target length, and nothing is written until iter is exhausted.
+func (r *rsync) WriteSignature(output io.Writer, iter func() (BlockHash, error)) error {
+	var blocks []BlockHash
+	var target_length uint64
+	for {
+		h, err := iter()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		blocks = append(blocks, h)
+		target_length += uint64(h.Length)
+	}
+	header := signatureHeader{
+		ChunkingMode: r.ChunkingMode, StrongHashID: StrongHashXXH3_64,
+		BlockSize: uint32(r.BlockSize), BlockCount: uint64(len(blocks)), TargetLength: target_length,
+	}
+	if r.ChunkingMode == ContentDefinedChunking {
+		min, avg, max := r.cdc_params()
+		header.BlockSize = 0
+		header.MinBlockSize, header.AvgBlockSize, header.MaxBlockSize = uint32(min), uint32(avg), uint32(max)
+	}
+
+	buf := make([]byte, len(signatureMagic)+signatureHeaderSize)
+	copy(buf, signatureMagic)
+	header.serialize(buf[len(signatureMagic):])
+	checksum := xxh3.Hash(buf)
+	if _, err := output.Write(buf); err != nil {
+		return err
+	}
+	var rbuf [BlockHashSize]byte
+	for _, h := range blocks {
+		h.Serialize(rbuf[:])
+		checksum = xxh3.HashSeed(rbuf[:], checksum)
+		if _, err := output.Write(rbuf[:]); err != nil {
+			return err
+		}
+	}
+	var footer [signatureFooterSize]byte
+	bin.PutUint64(footer[:], checksum)
+	_, err := output.Write(footer[:])
+	return err
+}
+
+const signatureFooterSize = 8
+
+// SignatureFile is a read-only view of a signature file written by
+// WriteSignature, backed by an io.ReaderAt (typically an mmap'd *os.File)
+// so that signatures with millions of blocks don't need to be loaded into
+// memory wholesale. Only a small sorted index of (weak hash, record index)
+// pairs is kept in memory, enough to binary-search Lookup down to a small
+// run of candidate records, similar in spirit to the fanout table in git's
+// pack idx files.
+type SignatureFile struct {
+	src         io.ReaderAt
+	header      signatureHeader
+	records_off int64
+
+	weak_sorted     []uint32
+	weak_record_idx []uint32
+}
+
+// Open reads and validates the header and footer of a signature file and
+// builds its in-memory weak-hash index. To do so it reads all block records
+// once, in a single buffer that is not kept; afterwards At and Lookup read
+// records from src on demand.
+func Open(src io.ReaderAt) (*SignatureFile, error) {
+	prefix := make([]byte, len(signatureMagic)+signatureHeaderSize)
+	if _, err := src.ReadAt(prefix, 0); err != nil {
+		return nil, fmt.Errorf("failed to read signature file header: %w", err)
+	}
+	if string(prefix[:len(signatureMagic)]) != signatureMagic {
+		return nil, fmt.Errorf("not a valid rsync signature file: bad magic")
+	}
+	sf := &SignatureFile{src: src, records_off: int64(len(prefix))}
+	sf.header.unserialize(prefix[len(signatureMagic):])
+	if sf.header.StrongHashID != StrongHashXXH3_64 {
+		return nil, fmt.Errorf("signature file uses unknown strong hash algorithm: %d", sf.header.StrongHashID)
+	}
+
+	records_size := int64(sf.header.BlockCount) * BlockHashSize
+	footer_off := sf.records_off + records_size
+	footer := make([]byte, signatureFooterSize)
+	if _, err := src.ReadAt(footer, footer_off); err != nil {
+		return nil, fmt.Errorf("failed to read signature file footer: %w", err)
+	}
+	expected := bin.Uint64(footer)
+
+	checksum := xxh3.Hash(prefix)
+	records := make([]byte, records_size)
+	if _, err := src.ReadAt(records, sf.records_off); err != nil {
+		return nil, fmt.Errorf("failed to read signature file records: %w", err)
+	}
+	for i := 0; i < len(records); i += BlockHashSize {
+		checksum = xxh3.HashSeed(records[i:i+BlockHashSize], checksum)
+	}
+	if checksum != expected {
+		return nil, fmt.Errorf("signature file is corrupt: checksum mismatch")
+	}
+
+	sf.weak_sorted = make([]uint32, sf.header.BlockCount)
+	sf.weak_record_idx = make([]uint32, sf.header.BlockCount)
+	for i := range sf.weak_sorted {
+		sf.weak_sorted[i] = bin.Uint32(records[i*BlockHashSize+8:])
+		sf.weak_record_idx[i] = uint32(i)
+	}
+	sort.Sort(&weak_hash_sorter{sf.weak_sorted, sf.weak_record_idx})
+
+	return sf, nil
+}
+
+type weak_hash_sorter struct {
+	weak []uint32
+	idx  []uint32
+}
+
+func (self *weak_hash_sorter) Len() int           { return len(self.weak) }
+func (self *weak_hash_sorter) Less(i, j int) bool { return self.weak[i] < self.weak[j] }
+func (self *weak_hash_sorter) Swap(i, j int) {
+	self.weak[i], self.weak[j] = self.weak[j], self.weak[i]
+	self.idx[i], self.idx[j] = self.idx[j], self.idx[i]
+}
+
+// Len returns the number of blocks in the signature.
+func (self *SignatureFile) Len() int { return int(self.header.BlockCount) }
+
+// At returns the i'th BlockHash, in the order it was written.
+func (self *SignatureFile) At(i int) BlockHash {
+	var buf [BlockHashSize]byte
+	if _, err := self.src.ReadAt(buf[:], self.records_off+int64(i)*BlockHashSize); err != nil {
+		panic(err) // the records were already validated against the footer checksum in Open
+	}
+	var h BlockHash
+	if err := h.Unserialize(buf[:]); err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// Lookup returns every BlockHash whose WeakHash is weak, in no particular
+// order. It runs in O(log(Len())) to find the matching run, plus O(1) per
+// returned BlockHash.
+func (self *SignatureFile) Lookup(weak uint32) []BlockHash {
+	lo := sort.Search(len(self.weak_sorted), func(i int) bool { return self.weak_sorted[i] >= weak })
+	hi := lo
+	for hi < len(self.weak_sorted) && self.weak_sorted[hi] == weak {
+		hi++
+	}
+	if lo == hi {
+		return nil
+	}
+	ans := make([]BlockHash, 0, hi-lo)
+	for _, idx := range self.weak_record_idx[lo:hi] {
+		ans = append(ans, self.At(int(idx)))
+	}
+	return ans
+}
+
+// SetSignatureFile is the *SignatureFile equivalent of SetSignature: it must
+// be called before ApplyDelta when the delta was generated against a
+// signature read via Open, so ApplyDelta can seek to a block's absolute
+// offset instead of assuming BlockSize*BlockIndex.
+func (r *rsync) SetSignatureFile(sf *SignatureFile) {
+	n := sf.Len()
+	r.block_offsets = make([]uint64, n+1)
+	for i := 0; i < n; i++ {
+		r.block_offsets[i+1] = r.block_offsets[i] + uint64(sf.At(i).Length)
+	}
+}
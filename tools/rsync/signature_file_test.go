@@ -0,0 +1,123 @@
+package rsync
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// TestWriteSignaturePreservesFixedBlocksMode guards against inferring
+// ChunkingMode from block lengths: a FixedBlocks target whose length isn't
+// a multiple of BlockSize has a short final block, which must still be
+// recorded as FixedBlocks with the real BlockSize, not ContentDefinedChunking
+// with BlockSize zeroed out.
+func TestWriteSignaturePreservesFixedBlocksMode(t *testing.T) {
+	target := bytes.Repeat([]byte("x"), DefaultBlockSize*3+500)
+	r := &rsync{BlockSize: DefaultBlockSize}
+	r.SetHasher(new_xxh3_64)
+	it := r.CreateSignatureIterator(bytes.NewReader(target))
+
+	buf := &bytes.Buffer{}
+	if err := r.WriteSignature(buf, it); err != nil {
+		t.Fatal(err)
+	}
+	sf, err := Open(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sf.header.ChunkingMode != FixedBlocks {
+		t.Fatalf("got ChunkingMode=%v, want FixedBlocks", sf.header.ChunkingMode)
+	}
+	if sf.header.BlockSize != uint32(DefaultBlockSize) {
+		t.Fatalf("got BlockSize=%d, want %d", sf.header.BlockSize, DefaultBlockSize)
+	}
+}
+
+// TestSignatureFileRoundTrip exercises WriteSignature -> Open ->
+// CreateDiffFromFile -> ApplyDelta end to end in ContentDefinedChunking
+// mode, and checks that Open rejects a corrupted file.
+func TestSignatureFileRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	target := make([]byte, 300*1024)
+	rng.Read(target)
+	source := make([]byte, 0, len(target)+64)
+	source = append(source, target[:77777]...)
+	source = append(source, []byte("XYZ-EDIT-MARKER-XYZ")...)
+	source = append(source, target[77777:]...)
+
+	new_cdc_rsync := func() *rsync {
+		r := &rsync{BlockSize: DefaultBlockSize, ChunkingMode: ContentDefinedChunking}
+		r.SetHasher(new_xxh3_64)
+		r.SetChecksummer(new_xxh3_128)
+		return r
+	}
+
+	sig_r := new_cdc_rsync()
+	it := sig_r.CreateSignatureIterator(bytes.NewReader(target))
+	buf := &bytes.Buffer{}
+	if err := sig_r.WriteSignature(buf, it); err != nil {
+		t.Fatal(err)
+	}
+
+	sf, err := Open(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sf.Len() == 0 {
+		t.Fatalf("expected non-empty signature")
+	}
+
+	in_mem_sig := signature_of(new_cdc_rsync(), target)
+	if sf.Len() != len(in_mem_sig) {
+		t.Fatalf("block count mismatch: file=%d mem=%d", sf.Len(), len(in_mem_sig))
+	}
+	for i, h := range in_mem_sig {
+		if got := sf.At(i); got != h {
+			t.Fatalf("block %d mismatch: file=%+v mem=%+v", i, got, h)
+		}
+	}
+	for _, h := range in_mem_sig {
+		found := false
+		for _, cand := range sf.Lookup(h.WeakHash) {
+			if cand.StrongHash == h.StrongHash {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("Lookup(%d) did not find block with strong hash %d", h.WeakHash, h.StrongHash)
+		}
+	}
+
+	diff_r := new_cdc_rsync()
+	diff := diff_r.CreateDiffFromFile(bytes.NewReader(source), sf)
+	var ops []Operation
+	for {
+		op, err := diff()
+		if op == nil {
+			if err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+		ops = append(ops, *op)
+	}
+
+	apply_r := new_cdc_rsync()
+	apply_r.SetSignatureFile(sf)
+	out := &bytes.Buffer{}
+	tr := bytes.NewReader(target)
+	for _, op := range ops {
+		if err := apply_r.ApplyDelta(out, tr, op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(out.Bytes(), source) {
+		t.Fatalf("CreateDiffFromFile round trip mismatch: got %d bytes, want %d bytes", out.Len(), len(source))
+	}
+
+	corrupt := append([]byte{}, buf.Bytes()...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	if _, err := Open(bytes.NewReader(corrupt)); err == nil {
+		t.Fatalf("expected Open to reject a corrupted signature file")
+	}
+}